@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+type accessRecordKey struct{}
+
+// accessRecord carries details that are only known once the request reaches
+// a route's Director, such as the rewritten Host header.
+type accessRecord struct {
+	upstreamHost string
+}
+
+func recordUpstreamHost(req *http.Request, host string) {
+	if record, ok := req.Context().Value(accessRecordKey{}).(*accessRecord); ok {
+		record.upstreamHost = host
+	}
+}
+
+// statusRecorder tracks the response status and the bytes moved in each
+// direction: request and response bodies for plain HTTP, and everything read
+// from or written to the client connection once a websocket is hijacked.
+type statusRecorder struct {
+	http.ResponseWriter
+	status   int
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 && code >= http.StatusOK {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytesOut.Add(int64(n))
+	return n, err
+}
+
+// Hijack records the protocol switch, since the reverse proxy writes the 101
+// response directly to the hijacked connection, and wraps that connection so
+// the websocket traffic relayed over it is counted.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(r.ResponseWriter).Hijack()
+	if err != nil {
+		return conn, rw, err
+	}
+	if r.status == 0 {
+		r.status = http.StatusSwitchingProtocols
+	}
+	counted := &countingConn{Conn: conn, in: &r.bytesIn, out: &r.bytesOut}
+	if rw.Writer.Buffered() == 0 {
+		rw.Writer.Reset(counted)
+	}
+	return counted, rw, nil
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+type countingConn struct {
+	net.Conn
+	in  *atomic.Int64
+	out *atomic.Int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.in.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.out.Add(int64(n))
+	return n, err
+}
+
+type countingBody struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	return n, err
+}
+
+func withAccessLog(next http.Handler, events *eventLogger, trustedProxies []*net.IPNet) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		record := &accessRecord{}
+		recorder := &statusRecorder{ResponseWriter: rw}
+		if req.Body != nil && req.Body != http.NoBody {
+			req.Body = &countingBody{ReadCloser: req.Body, n: &recorder.bytesIn}
+		}
+		next.ServeHTTP(recorder, req.WithContext(context.WithValue(req.Context(), accessRecordKey{}, record)))
+
+		duration := time.Since(start)
+		client := clientIP(req, trustedProxies)
+		protocol := "http"
+		if isWebSocketRequest(req) {
+			protocol = "websocket"
+		}
+		events.emit(levelInfo, proxyEvent{
+			Event:        "access",
+			RemoteAddr:   client,
+			Method:       req.Method,
+			Path:         req.URL.Path,
+			Protocol:     protocol,
+			Status:       recorder.status,
+			UpstreamHost: record.upstreamHost,
+			BytesIn:      recorder.bytesIn.Load(),
+			BytesOut:     recorder.bytesOut.Load(),
+			DurationMs:   duration.Milliseconds(),
+		}, fmt.Sprintf(
+			"%s %s %d %s in=%dB out=%dB client=%s host=%s",
+			req.Method,
+			req.URL.Path,
+			recorder.status,
+			duration.Round(time.Millisecond),
+			recorder.bytesIn.Load(),
+			recorder.bytesOut.Load(),
+			client,
+			record.upstreamHost,
+		))
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// accessEvent waits for the access event written once the handler returns.
+func (b *lockedBuffer) accessEvent(t *testing.T) proxyEvent {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		b.mu.Lock()
+		lines := strings.Split(b.buf.String(), "\n")
+		b.mu.Unlock()
+		for _, line := range lines {
+			var event proxyEvent
+			if json.Unmarshal([]byte(line), &event) == nil && event.Event == "access" {
+				return event
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no access event logged")
+	return proxyEvent{}
+}
+
+func newAccessLogFrontend(t *testing.T, backend *httptest.Server) (*httptest.Server, *lockedBuffer) {
+	t.Helper()
+	cfg := proxyConfig{targetScheme: "http", dialNetwork: "tcp"}
+	output := &lockedBuffer{}
+	events := &eventLogger{json: true, level: levelDebug, output: log.New(output, "", 0)}
+	transport := testTransport(t, cfg)
+	frontend := httptest.NewServer(withAccessLog(newCDPProxy(cfg, backendRoute(t, backend), transport, events), events, nil))
+	t.Cleanup(frontend.Close)
+	return frontend, output
+}
+
+func TestAccessLogCountsWebsocketBytes(t *testing.T) {
+	const payloadSize = 1000
+	backend := websocketBackend(t, func(_ *http.Request, rw *bufio.ReadWriter) {
+		_, _ = io.CopyN(rw, rw, payloadSize)
+		_ = rw.Flush()
+	})
+	frontend, output := newAccessLogFrontend(t, backend)
+
+	conn, reader, resp := dialWebsocket(t, frontend.Listener.Addr().String(), "/devtools/page/A1")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", resp.StatusCode)
+	}
+	if _, err := conn.Write(bytes.Repeat([]byte("x"), payloadSize)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(reader, make([]byte, payloadSize)); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+
+	event := output.accessEvent(t)
+	if event.Status != http.StatusSwitchingProtocols || event.Protocol != "websocket" {
+		t.Fatalf("access event = %+v, want a websocket 101", event)
+	}
+	if event.BytesIn != payloadSize {
+		t.Errorf("bytes_in = %d, want %d", event.BytesIn, payloadSize)
+	}
+	// The 101 response head is written to the client too.
+	if event.BytesOut <= payloadSize {
+		t.Errorf("bytes_out = %d, want more than %d", event.BytesOut, payloadSize)
+	}
+}
+
+func TestAccessLogCountsRequestBody(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		_, _ = w.Write([]byte("created"))
+	}))
+	defer backend.Close()
+	frontend, output := newAccessLogFrontend(t, backend)
+
+	resp, err := http.Post(frontend.URL+"/json/new", "text/plain", strings.NewReader(strings.Repeat("y", 300)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	event := output.accessEvent(t)
+	if event.BytesIn != 300 || event.BytesOut != int64(len("created")) {
+		t.Errorf("bytes_in = %d, bytes_out = %d, want 300 and %d", event.BytesIn, event.BytesOut, len("created"))
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+func parseCIDRList(raw string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				log.Fatalf("invalid CIDR value %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Fatalf("invalid CIDR value %q", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+func fromTrustedProxy(r *http.Request, trustedProxies []*net.IPNet) bool {
+	peer := remoteIP(r)
+	return peer != nil && containsIP(trustedProxies, peer)
+}
+
+// forwardedHost returns the host the client addressed. X-Forwarded-Host is
+// only consulted when the immediate peer is a trusted proxy, and its first
+// value, set by the proxy closest to the client, wins.
+func forwardedHost(r *http.Request, trustedProxies []*net.IPNet) string {
+	if !fromTrustedProxy(r, trustedProxies) {
+		return r.Host
+	}
+	host, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Host"), ",")
+	if host = strings.TrimSpace(host); host != "" {
+		return host
+	}
+	return r.Host
+}
+
+// forwardedScheme returns the scheme, http or https, the client used to reach
+// the proxy. A TLS connection is https; otherwise X-Forwarded-Proto is read
+// like X-Forwarded-Host in forwardedHost.
+func forwardedScheme(r *http.Request, trustedProxies []*net.IPNet) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	if !fromTrustedProxy(r, trustedProxies) {
+		return "http"
+	}
+	proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+	if strings.EqualFold(strings.TrimSpace(proto), "https") {
+		return "https"
+	}
+	return "http"
+}
+
+// resolveClientIP returns the address of the client that originated the
+// request. X-Forwarded-For is only consulted when the immediate peer is a
+// trusted proxy, and is walked right to left until the first untrusted hop.
+// A hop that is not an IP fails the lookup rather than attributing the
+// request to the trusted proxy in front of it.
+func resolveClientIP(r *http.Request, trustedProxies []*net.IPNet) (net.IP, error) {
+	peer := remoteIP(r)
+	if peer == nil {
+		return nil, fmt.Errorf("invalid remote address %q", r.RemoteAddr)
+	}
+	if !containsIP(trustedProxies, peer) {
+		return peer, nil
+	}
+	forwarded := strings.Join(r.Header.Values("X-Forwarded-For"), ",")
+	if strings.TrimSpace(forwarded) == "" {
+		return peer, nil
+	}
+	hops := strings.Split(forwarded, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			return nil, fmt.Errorf("invalid X-Forwarded-For hop %q", strings.TrimSpace(hops[i]))
+		}
+		if !containsIP(trustedProxies, ip) {
+			return ip, nil
+		}
+	}
+	return net.ParseIP(strings.TrimSpace(hops[0])), nil
+}
+
+// clientIP is resolveClientIP for logging. Requests it cannot resolve are
+// logged under the immediate peer's address.
+func clientIP(r *http.Request, trustedProxies []*net.IPNet) string {
+	ip, err := resolveClientIP(r, trustedProxies)
+	if err != nil {
+		if peer := remoteIP(r); peer != nil {
+			return peer.String()
+		}
+		return r.RemoteAddr
+	}
+	return ip.String()
+}
+
+func allowCIDRs(next http.Handler, allowed []*net.IPNet, trustedProxies []*net.IPNet, events *eventLogger) http.Handler {
+	if len(allowed) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ip, err := resolveClientIP(req, trustedProxies)
+		if err != nil {
+			events.logf(levelWarn, "rejected request from %s: %v", req.RemoteAddr, err)
+			http.Error(rw, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if !containsIP(allowed, ip) {
+			events.logf(levelWarn, "rejected request from %s: not in allowlist", ip)
+			http.Error(rw, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseCIDRList(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want []string
+	}{
+		{raw: "", want: nil},
+		{raw: " , ", want: nil},
+		{raw: "10.0.0.1", want: []string{"10.0.0.1/32"}},
+		{raw: "2001:db8::1", want: []string{"2001:db8::1/128"}},
+		{raw: "10.0.0.0/8, 192.168.1.7", want: []string{"10.0.0.0/8", "192.168.1.7/32"}},
+		{raw: "10.1.2.3/8", want: []string{"10.0.0.0/8"}},
+	}
+	for _, tt := range tests {
+		got := parseCIDRList(tt.raw)
+		if len(got) != len(tt.want) {
+			t.Errorf("parseCIDRList(%q) = %v, want %v", tt.raw, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i].String() != tt.want[i] {
+				t.Errorf("parseCIDRList(%q)[%d] = %s, want %s", tt.raw, i, got[i], tt.want[i])
+			}
+		}
+	}
+
+	// A bare IP matches only itself.
+	single := parseCIDRList("10.0.0.1")
+	if !containsIP(single, remoteIP(&http.Request{RemoteAddr: "10.0.0.1:1234"})) {
+		t.Error("10.0.0.1 not matched by its own /32")
+	}
+	if containsIP(single, remoteIP(&http.Request{RemoteAddr: "10.0.0.2:1234"})) {
+		t.Error("10.0.0.2 matched by 10.0.0.1/32")
+	}
+}
+
+func TestResolveClientIP(t *testing.T) {
+	trusted := parseCIDRList("10.0.0.0/8")
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+		wantErr    bool
+	}{
+		{name: "direct peer", remoteAddr: "192.0.2.10:5000", want: "192.0.2.10"},
+		{name: "untrusted peer ignores forwarded", remoteAddr: "192.0.2.10:5000", forwarded: []string{"10.0.0.1"}, want: "192.0.2.10"},
+		{name: "trusted peer without header", remoteAddr: "10.0.0.1:5000", want: "10.0.0.1"},
+		{name: "trusted peer single hop", remoteAddr: "10.0.0.1:5000", forwarded: []string{"198.51.100.7"}, want: "198.51.100.7"},
+		{name: "trusted peer multi hop", remoteAddr: "10.0.0.1:5000", forwarded: []string{"203.0.113.9, 198.51.100.7, 10.0.0.2"}, want: "198.51.100.7"},
+		{name: "trusted peer repeated headers", remoteAddr: "10.0.0.1:5000", forwarded: []string{"203.0.113.9", "198.51.100.7, 10.0.0.2"}, want: "198.51.100.7"},
+		{name: "all hops trusted", remoteAddr: "10.0.0.1:5000", forwarded: []string{"10.0.0.3, 10.0.0.2"}, want: "10.0.0.3"},
+		{name: "ipv4-mapped trusted peer", remoteAddr: "[::ffff:10.0.0.1]:5000", forwarded: []string{"198.51.100.7"}, want: "198.51.100.7"},
+		{name: "ipv4-mapped untrusted peer", remoteAddr: "[::ffff:192.0.2.10]:5000", want: "192.0.2.10"},
+		{name: "unparseable hop", remoteAddr: "10.0.0.1:5000", forwarded: []string{"garbage"}, wantErr: true},
+		{name: "unparseable hop behind client", remoteAddr: "10.0.0.1:5000", forwarded: []string{"198.51.100.7, garbage"}, wantErr: true},
+		{name: "invalid remote address", remoteAddr: "not-an-address", wantErr: true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/json", nil)
+		req.RemoteAddr = tt.remoteAddr
+		for _, value := range tt.forwarded {
+			req.Header.Add("X-Forwarded-For", value)
+		}
+		got, err := resolveClientIP(req, trusted)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: resolveClientIP = %s, want error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: resolveClientIP returned error: %v", tt.name, err)
+			continue
+		}
+		if got.String() != tt.want {
+			t.Errorf("%s: resolveClientIP = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAllowCIDRs(t *testing.T) {
+	events := newEventLogger("", levelError)
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	tests := []struct {
+		name       string
+		allowed    string
+		trusted    string
+		remoteAddr string
+		forwarded  string
+		want       int
+	}{
+		{name: "empty allowlist", remoteAddr: "192.0.2.10:5000", want: http.StatusOK},
+		{name: "allowed peer", allowed: "192.0.2.0/24", remoteAddr: "192.0.2.10:5000", want: http.StatusOK},
+		{name: "denied peer", allowed: "192.0.2.0/24", remoteAddr: "198.51.100.7:5000", want: http.StatusForbidden},
+		{name: "bare ip allowlist", allowed: "192.0.2.10", remoteAddr: "192.0.2.11:5000", want: http.StatusForbidden},
+		{name: "untrusted peer spoofing forwarded", allowed: "192.0.2.10", trusted: "10.0.0.0/8", remoteAddr: "198.51.100.7:5000", forwarded: "192.0.2.10", want: http.StatusForbidden},
+		{name: "spoofing without trusted proxies", allowed: "192.0.2.10", remoteAddr: "198.51.100.7:5000", forwarded: "192.0.2.10", want: http.StatusForbidden},
+		{name: "trusted peer forwarding allowed client", allowed: "192.0.2.10", trusted: "10.0.0.0/8", remoteAddr: "10.0.0.1:5000", forwarded: "192.0.2.10", want: http.StatusOK},
+		{name: "trusted peer forwarding denied client", allowed: "10.0.0.0/8", trusted: "10.0.0.0/8", remoteAddr: "10.0.0.1:5000", forwarded: "198.51.100.7, 10.0.0.2", want: http.StatusForbidden},
+		{name: "ipv4-mapped peer", allowed: "192.0.2.0/24", remoteAddr: "[::ffff:192.0.2.10]:5000", want: http.StatusOK},
+		// The proxy's own range being allowed must not let an unparseable
+		// hop through under the proxy's address.
+		{name: "unparseable hop", allowed: "10.0.0.0/8", trusted: "10.0.0.0/8", remoteAddr: "10.0.0.1:5000", forwarded: "garbage", want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		handler := allowCIDRs(next, parseCIDRList(tt.allowed), parseCIDRList(tt.trusted), events)
+		req := httptest.NewRequest(http.MethodGet, "/json", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+)
+
+func constantTimeEqual(a string, b string) bool {
+	left := sha256.Sum256([]byte(a))
+	right := sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(left[:], right[:]) == 1
+}
+
+// requireBasicAuth rejects requests, including websocket upgrades, whose
+// Basic credentials do not match. An empty user disables the check.
+func requireBasicAuth(next http.Handler, user string, pass string) http.Handler {
+	if user == "" {
+		return next
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		gotUser, gotPass, ok := req.BasicAuth()
+		userOK := constantTimeEqual(gotUser, user)
+		passOK := constantTimeEqual(gotPass, pass)
+		if !ok || !userOK || !passOK {
+			rw.Header().Set("WWW-Authenticate", `Basic realm="cmux-cdp", charset="UTF-8"`)
+			http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		req.Header.Del("Authorization")
+		next.ServeHTTP(rw, req)
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBasicAuthWebsocketUpgrade(t *testing.T) {
+	backendAuth := make(chan string, 1)
+	backend := websocketBackend(t, func(req *http.Request, _ *bufio.ReadWriter) {
+		backendAuth <- req.Header.Get("Authorization")
+	})
+	cfg := proxyConfig{targetScheme: "http", dialNetwork: "tcp"}
+	proxy := newCDPProxy(cfg, backendRoute(t, backend), testTransport(t, cfg), newEventLogger("", levelError))
+	frontend := httptest.NewServer(requireBasicAuth(proxy, "cdp", "s3cret"))
+	defer frontend.Close()
+
+	tests := []struct {
+		name          string
+		authorization string
+		want          int
+	}{
+		{name: "missing credentials", want: http.StatusUnauthorized},
+		{name: "wrong password", authorization: basicAuth("cdp", "wrong"), want: http.StatusUnauthorized},
+		{name: "wrong user", authorization: basicAuth("admin", "s3cret"), want: http.StatusUnauthorized},
+		{name: "not basic", authorization: "Bearer s3cret", want: http.StatusUnauthorized},
+		{name: "correct credentials", authorization: basicAuth("cdp", "s3cret"), want: http.StatusSwitchingProtocols},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var headers []string
+			if tt.authorization != "" {
+				headers = append(headers, "Authorization: "+tt.authorization)
+			}
+			_, _, resp := dialWebsocket(t, frontend.Listener.Addr().String(), "/devtools/page/A1", headers...)
+			_ = resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+			if tt.want == http.StatusUnauthorized {
+				if resp.Header.Get("WWW-Authenticate") == "" {
+					t.Error("401 response has no WWW-Authenticate header")
+				}
+				return
+			}
+			if got := <-backendAuth; got != "" {
+				t.Errorf("backend received Authorization %q, want it stripped", got)
+			}
+		})
+	}
+	select {
+	case got := <-backendAuth:
+		t.Errorf("rejected request reached the backend (Authorization %q)", got)
+	default:
+	}
+}
+
+func basicAuth(user string, pass string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+}
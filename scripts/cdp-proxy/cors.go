@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+func parseOriginList(raw string) []string {
+	var origins []string
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry != "" {
+			origins = append(origins, entry)
+		}
+	}
+	return origins
+}
+
+func allowedOrigin(origins []string, origin string) string {
+	for _, allowed := range origins {
+		if allowed == "*" {
+			return "*"
+		}
+		if origin != "" && strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// withCORS adds Access-Control-Allow-Origin for the configured origins and
+// answers preflight requests itself, so they never reach Chrome. Proxied
+// responses drop the backend's own value in replaceBackendCORS so clients
+// see exactly one. An empty origin list leaves requests untouched.
+func withCORS(next http.Handler, origins []string) http.Handler {
+	if len(origins) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		origin := req.Header.Get("Origin")
+		allowed := allowedOrigin(origins, origin)
+		if allowed != "" {
+			rw.Header().Set("Access-Control-Allow-Origin", allowed)
+			if allowed != "*" {
+				rw.Header().Add("Vary", "Origin")
+			}
+		}
+		if req.Method != http.MethodOptions || req.Header.Get("Access-Control-Request-Method") == "" {
+			next.ServeHTTP(rw, req)
+			return
+		}
+		if allowed == "" {
+			http.Error(rw, "Forbidden", http.StatusForbidden)
+			return
+		}
+		rw.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, OPTIONS")
+		if headers := req.Header.Get("Access-Control-Request-Headers"); headers != "" {
+			rw.Header().Set("Access-Control-Allow-Headers", headers)
+		}
+		rw.Header().Set("Access-Control-Max-Age", "600")
+		rw.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// replaceBackendCORS removes the CORS headers from a proxied response when
+// the proxy manages CORS itself. httputil.ReverseProxy adds the backend's
+// headers to those withCORS already set, and browsers reject a response with
+// two Access-Control-Allow-Origin values.
+func replaceBackendCORS(resp *http.Response, origins []string) {
+	if len(origins) == 0 {
+		return
+	}
+	for _, name := range []string{
+		"Access-Control-Allow-Origin",
+		"Access-Control-Allow-Credentials",
+		"Access-Control-Allow-Methods",
+		"Access-Control-Allow-Headers",
+		"Access-Control-Max-Age",
+	} {
+		resp.Header.Del(name)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestWithCORS(t *testing.T) {
+	var reachedNext bool
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		reachedNext = true
+		w.WriteHeader(http.StatusOK)
+	})
+	tests := []struct {
+		name        string
+		origins     string
+		method      string
+		origin      string
+		preflight   bool
+		wantStatus  int
+		wantOrigin  string
+		wantVary    bool
+		wantNext    bool
+		wantMethods bool
+	}{
+		{name: "disabled", method: http.MethodGet, origin: "https://a.example", wantStatus: http.StatusOK, wantNext: true},
+		{name: "simple get allowed", origins: "https://a.example", method: http.MethodGet, origin: "https://a.example", wantStatus: http.StatusOK, wantOrigin: "https://a.example", wantVary: true, wantNext: true},
+		{name: "simple get case-insensitive", origins: "https://A.example", method: http.MethodGet, origin: "https://a.example", wantStatus: http.StatusOK, wantOrigin: "https://a.example", wantVary: true, wantNext: true},
+		{name: "simple get other origin", origins: "https://a.example", method: http.MethodGet, origin: "https://b.example", wantStatus: http.StatusOK, wantNext: true},
+		{name: "simple get wildcard", origins: "*", method: http.MethodGet, origin: "https://b.example", wantStatus: http.StatusOK, wantOrigin: "*", wantNext: true},
+		{name: "preflight allowed", origins: "https://a.example", method: http.MethodOptions, origin: "https://a.example", preflight: true, wantStatus: http.StatusNoContent, wantOrigin: "https://a.example", wantVary: true, wantMethods: true},
+		{name: "preflight wildcard", origins: "*", method: http.MethodOptions, origin: "https://b.example", preflight: true, wantStatus: http.StatusNoContent, wantOrigin: "*", wantMethods: true},
+		{name: "preflight rejected", origins: "https://a.example", method: http.MethodOptions, origin: "https://b.example", preflight: true, wantStatus: http.StatusForbidden},
+		{name: "plain options passes through", origins: "https://a.example", method: http.MethodOptions, origin: "https://a.example", wantStatus: http.StatusOK, wantOrigin: "https://a.example", wantVary: true, wantNext: true},
+	}
+	for _, tt := range tests {
+		reachedNext = false
+		handler := withCORS(next, parseOriginList(tt.origins))
+		req := httptest.NewRequest(tt.method, "/json", nil)
+		req.Header.Set("Origin", tt.origin)
+		if tt.preflight {
+			req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+			req.Header.Set("Access-Control-Request-Headers", "content-type")
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, tt.wantStatus)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+			t.Errorf("%s: Access-Control-Allow-Origin = %q, want %q", tt.name, got, tt.wantOrigin)
+		}
+		if got := rec.Header().Get("Vary") == "Origin"; got != tt.wantVary {
+			t.Errorf("%s: Vary = %q, want Origin: %v", tt.name, rec.Header().Get("Vary"), tt.wantVary)
+		}
+		if reachedNext != tt.wantNext {
+			t.Errorf("%s: reached next handler = %v, want %v", tt.name, reachedNext, tt.wantNext)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Methods") != ""; got != tt.wantMethods {
+			t.Errorf("%s: Access-Control-Allow-Methods = %q", tt.name, rec.Header().Get("Access-Control-Allow-Methods"))
+		}
+		if tt.wantMethods && rec.Header().Get("Access-Control-Allow-Headers") != "content-type" {
+			t.Errorf("%s: Access-Control-Allow-Headers = %q, want content-type", tt.name, rec.Header().Get("Access-Control-Allow-Headers"))
+		}
+	}
+}
+
+func TestCORSReplacesBackendOrigin(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"Browser":"HeadlessChrome"}`))
+	}))
+	defer backend.Close()
+	route := backendRoute(t, backend)
+	tests := []struct {
+		name    string
+		origins []string
+		origin  string
+		want    []string
+	}{
+		{name: "allowed origin", origins: []string{"https://a.example"}, origin: "https://a.example", want: []string{"https://a.example"}},
+		{name: "other origin", origins: []string{"https://a.example"}, origin: "https://b.example", want: nil},
+		{name: "disabled keeps backend value", origin: "https://a.example", want: []string{"*"}},
+	}
+	for _, tt := range tests {
+		cfg := proxyConfig{targetScheme: "http", dialNetwork: "tcp", corsOrigins: tt.origins}
+		transport := testTransport(t, cfg)
+		frontend := httptest.NewServer(withCORS(newCDPProxy(cfg, route, transport, newEventLogger("", levelError)), cfg.corsOrigins))
+
+		req, err := http.NewRequest(http.MethodGet, frontend.URL+"/json/version", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Origin", tt.origin)
+		resp, err := frontend.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if got := resp.Header.Values("Access-Control-Allow-Origin"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Access-Control-Allow-Origin = %q, want %q", tt.name, got, tt.want)
+		}
+		frontend.Close()
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+func isJSONEndpoint(path string) bool {
+	return path == "/json" || strings.HasPrefix(path, "/json/")
+}
+
+func isWebSocketRequest(req *http.Request) bool {
+	return strings.EqualFold(req.Header.Get("Upgrade"), "websocket")
+}
+
+// rewriteDebuggerURLs points the webSocketDebuggerUrl and devtoolsFrontendUrl
+// fields returned by Chrome's /json endpoints at publicHost so clients
+// reconnect through the proxy instead of dialing the backend directly. The
+// websocket scheme is replaced with wsScheme, since the backend's scheme says
+// nothing about how clients reach the proxy. The route prefix, if any, is
+// prepended to the rewritten paths. Both the list form (/json, /json/list)
+// and the single-target form (/json/version, /json/new) are handled.
+func rewriteDebuggerURLs(resp *http.Response, wsScheme string, publicHost string, prefix string) error {
+	if publicHost == "" || resp.StatusCode != http.StatusOK || !isJSONEndpoint(resp.Request.URL.Path) {
+		return nil
+	}
+	if resp.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		return nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	// Large documents such as /json/protocol carry no target URLs and are
+	// passed through as buffered.
+	if !bytes.Contains(body, []byte(`"webSocketDebuggerUrl"`)) && !bytes.Contains(body, []byte(`"devtoolsFrontendUrl"`)) {
+		return nil
+	}
+
+	var payload json.RawMessage
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil
+	}
+	var rewritten any
+	changed := false
+	switch bytes.TrimSpace(payload)[0] {
+	case '[':
+		var entries []json.RawMessage
+		if err := json.Unmarshal(payload, &entries); err != nil {
+			return nil
+		}
+		for i, entry := range entries {
+			if target, ok := parseTargetObject(entry); ok && rewriteTarget(target, wsScheme, publicHost, prefix) {
+				changed = true
+				encoded, err := target.MarshalJSON()
+				if err != nil {
+					return err
+				}
+				entries[i] = encoded
+			}
+		}
+		rewritten = entries
+	case '{':
+		target, ok := parseTargetObject(payload)
+		if !ok {
+			return nil
+		}
+		changed = rewriteTarget(target, wsScheme, publicHost, prefix)
+		rewritten = target
+	default:
+		return nil
+	}
+	if !changed {
+		return nil
+	}
+
+	var out bytes.Buffer
+	encoder := json.NewEncoder(&out)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "   ")
+	if err := encoder.Encode(rewritten); err != nil {
+		return err
+	}
+	resp.Body = io.NopCloser(&out)
+	resp.ContentLength = int64(out.Len())
+	resp.Header.Set("Content-Length", strconv.Itoa(out.Len()))
+	return nil
+}
+
+type targetField struct {
+	key   string
+	value json.RawMessage
+}
+
+// targetObject is a JSON object decoded without interpreting its values, so
+// fields the proxy does not rewrite keep their original order and bytes
+// (large integers in particular would otherwise round-trip through float64).
+type targetObject []targetField
+
+func parseTargetObject(raw json.RawMessage) (targetObject, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil, false
+	}
+	var target targetObject
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, false
+		}
+		key, ok := token.(string)
+		if !ok {
+			return nil, false
+		}
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return nil, false
+		}
+		target = append(target, targetField{key: key, value: value})
+	}
+	return target, true
+}
+
+func (t targetObject) MarshalJSON() ([]byte, error) {
+	var out bytes.Buffer
+	out.WriteByte('{')
+	for i, field := range t {
+		if i > 0 {
+			out.WriteByte(',')
+		}
+		key, err := marshalString(field.key)
+		if err != nil {
+			return nil, err
+		}
+		out.Write(key)
+		out.WriteByte(':')
+		out.Write(field.value)
+	}
+	out.WriteByte('}')
+	return out.Bytes(), nil
+}
+
+func (t targetObject) stringField(key string) (string, bool) {
+	for _, field := range t {
+		if field.key == key {
+			var value string
+			if err := json.Unmarshal(field.value, &value); err != nil {
+				return "", false
+			}
+			return value, true
+		}
+	}
+	return "", false
+}
+
+func (t targetObject) setStringField(key string, value string) {
+	encoded, err := marshalString(value)
+	if err != nil {
+		return
+	}
+	for i := range t {
+		if t[i].key == key {
+			t[i].value = encoded
+		}
+	}
+}
+
+func marshalString(value string) ([]byte, error) {
+	var out bytes.Buffer
+	encoder := json.NewEncoder(&out)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(out.Bytes(), []byte("\n")), nil
+}
+
+// rewriteTarget reports whether either URL field was changed.
+func rewriteTarget(target targetObject, wsScheme string, publicHost string, prefix string) bool {
+	changed := false
+	if raw, ok := target.stringField("webSocketDebuggerUrl"); ok && raw != "" {
+		if parsed, err := url.Parse(raw); err == nil {
+			parsed.Scheme = wsScheme
+			parsed.Host = publicHost
+			parsed.Path = prefix + parsed.Path
+			if rewritten := parsed.String(); rewritten != raw {
+				target.setStringField("webSocketDebuggerUrl", rewritten)
+				changed = true
+			}
+		}
+	}
+	if raw, ok := target.stringField("devtoolsFrontendUrl"); ok && raw != "" {
+		if rewritten := rewriteFrontendURL(raw, wsScheme, publicHost, prefix); rewritten != raw {
+			target.setStringField("devtoolsFrontendUrl", rewritten)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// rewriteFrontendURL replaces the ws= or wss= query parameter of a DevTools
+// frontend URL with one keyed by wsScheme and pointing at publicHost. The
+// query is edited in place rather than re-encoded so the path separators in
+// the parameter stay unescaped.
+func rewriteFrontendURL(raw string, wsScheme string, publicHost string, prefix string) string {
+	base, query, found := strings.Cut(raw, "?")
+	if !found {
+		return raw
+	}
+	if strings.HasPrefix(base, "/") {
+		base = prefix + base
+	}
+	params := strings.Split(query, "&")
+	for i, param := range params {
+		key, value, ok := strings.Cut(param, "=")
+		if !ok || (key != "ws" && key != "wss") {
+			continue
+		}
+		_, path, _ := strings.Cut(value, "/")
+		params[i] = wsScheme + "=" + publicHost + prefix + "/" + path
+	}
+	return base + "?" + strings.Join(params, "&")
+}
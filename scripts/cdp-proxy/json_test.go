@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRewriteDebuggerURLsPreservesUntouchedFields(t *testing.T) {
+	body := `[{"id":"A1","big":12345678901234567890,"webSocketDebuggerUrl":"ws://127.0.0.1:9222/devtools/page/A1","nested":{"z":1,"a":2.50}}]`
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json; charset=UTF-8"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    &http.Request{URL: &url.URL{Path: "/json/list"}},
+	}
+	if err := rewriteDebuggerURLs(resp, "wss", "proxy.example:443", "/a"); err != nil {
+		t.Fatalf("rewriteDebuggerURLs: %v", err)
+	}
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, got); err != nil {
+		t.Fatalf("invalid JSON %q: %v", got, err)
+	}
+	want := `[{"id":"A1","big":12345678901234567890,"webSocketDebuggerUrl":"wss://proxy.example:443/a/devtools/page/A1","nested":{"z":1,"a":2.50}}]`
+	if compact.String() != want {
+		t.Fatalf("rewritten body = %s, want %s", compact.String(), want)
+	}
+	if resp.ContentLength != int64(len(got)) {
+		t.Fatalf("ContentLength = %d, want %d", resp.ContentLength, len(got))
+	}
+}
+
+func TestRewriteDebuggerURLsLeavesUnrelatedBodiesAlone(t *testing.T) {
+	bodies := map[string]string{
+		"/json/protocol": `{"version": {"major": "1", "minor": "3"}, "domains": [{"domain": "Page"}]}`,
+		"/json/version":  `{"Browser": "HeadlessChrome/140.0", "webSocketDebuggerUrl": ""}`,
+	}
+	for path, body := range bodies {
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    &http.Request{URL: &url.URL{Path: path}},
+		}
+		if err := rewriteDebuggerURLs(resp, "ws", "proxy.example:443", ""); err != nil {
+			t.Fatalf("%s: rewriteDebuggerURLs: %v", path, err)
+		}
+		got, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != body {
+			t.Errorf("%s: body = %s, want it unchanged", path, got)
+		}
+		if resp.Header.Get("Content-Length") != "" {
+			t.Errorf("%s: Content-Length was rewritten to %s", path, resp.Header.Get("Content-Length"))
+		}
+	}
+}
+
+func TestProxyRewritesSchemeForClientSide(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `[{"id":"A1","webSocketDebuggerUrl":"wss://127.0.0.1:9222/devtools/page/A1","devtoolsFrontendUrl":"/devtools/inspector.html?wss=127.0.0.1:9222/devtools/page/A1"}]`)
+	}))
+	defer backend.Close()
+	route := backendRoute(t, backend)
+	events := newEventLogger("", levelError)
+
+	tests := []struct {
+		name           string
+		tls            bool
+		trustedProxies []*net.IPNet
+		publicAddr     publicAddress
+		forwardedHost  string
+		forwardedProto string
+		wantScheme     string
+		wantHost       string
+	}{
+		{name: "plaintext listener", wantScheme: "ws"},
+		{name: "tls listener", tls: true, wantScheme: "wss"},
+		{name: "trusted forwarded https", trustedProxies: parseCIDRList("127.0.0.0/8"), forwardedProto: "https", wantScheme: "wss"},
+		{name: "trusted forwarded http", trustedProxies: parseCIDRList("127.0.0.0/8"), forwardedProto: "http", wantScheme: "ws"},
+		{name: "untrusted forwarded https", forwardedProto: "https", wantScheme: "ws"},
+		{name: "trusted forwarded host", trustedProxies: parseCIDRList("127.0.0.0/8"), forwardedHost: "cdp.example:443", forwardedProto: "https", wantScheme: "wss", wantHost: "cdp.example:443"},
+		{name: "untrusted forwarded host", forwardedHost: "cdp.example:443", wantScheme: "ws"},
+		{name: "configured scheme", publicAddr: publicAddress{scheme: "wss", host: "proxy.example:443"}, wantScheme: "wss", wantHost: "proxy.example:443"},
+		{name: "configured host only", tls: true, publicAddr: publicAddress{host: "proxy.example:443"}, wantScheme: "wss", wantHost: "proxy.example:443"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := proxyConfig{targetScheme: "https", targetInsecure: true, dialNetwork: "tcp", trustedProxies: tt.trustedProxies, publicAddr: tt.publicAddr}
+			handler := newCDPProxy(cfg, route, testTransport(t, cfg), events)
+			var frontend *httptest.Server
+			if tt.tls {
+				frontend = httptest.NewTLSServer(handler)
+			} else {
+				frontend = httptest.NewServer(handler)
+			}
+			defer frontend.Close()
+
+			req, err := http.NewRequest(http.MethodGet, frontend.URL+"/json/list", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.forwardedHost != "" {
+				req.Header.Set("X-Forwarded-Host", tt.forwardedHost)
+			}
+			if tt.forwardedProto != "" {
+				req.Header.Set("X-Forwarded-Proto", tt.forwardedProto)
+			}
+			resp, err := frontend.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			var targets []map[string]string
+			if err := json.NewDecoder(resp.Body).Decode(&targets); err != nil {
+				t.Fatal(err)
+			}
+			if len(targets) != 1 {
+				t.Fatalf("got %d targets, want 1", len(targets))
+			}
+			publicHost := tt.wantHost
+			if publicHost == "" {
+				publicHost = frontend.Listener.Addr().String()
+			}
+			wantWS := tt.wantScheme + "://" + publicHost + "/devtools/page/A1"
+			if got := targets[0]["webSocketDebuggerUrl"]; got != wantWS {
+				t.Errorf("webSocketDebuggerUrl = %s, want %s", got, wantWS)
+			}
+			wantFrontend := "/devtools/inspector.html?" + tt.wantScheme + "=" + publicHost + "/devtools/page/A1"
+			if got := targets[0]["devtoolsFrontendUrl"]; got != wantFrontend {
+				t.Errorf("devtoolsFrontendUrl = %s, want %s", got, wantFrontend)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+func (l logLevel) String() string {
+	switch l {
+	case levelDebug:
+		return "debug"
+	case levelWarn:
+		return "warn"
+	case levelError:
+		return "error"
+	default:
+		return "info"
+	}
+}
+
+func parseLogLevel(raw string) logLevel {
+	switch strings.ToLower(strings.TrimSpace(raw)) {
+	case "debug":
+		return levelDebug
+	case "", "info":
+		return levelInfo
+	case "warn", "warning":
+		return levelWarn
+	case "error":
+		return levelError
+	default:
+		log.Fatalf("invalid log level %q (expected debug, info, warn or error)", raw)
+		return levelInfo
+	}
+}
+
+type proxyEvent struct {
+	Time         string `json:"time"`
+	Level        string `json:"level"`
+	Event        string `json:"event"`
+	Message      string `json:"message,omitempty"`
+	RemoteAddr   string `json:"remote_addr,omitempty"`
+	Method       string `json:"method,omitempty"`
+	Path         string `json:"path,omitempty"`
+	Protocol     string `json:"protocol,omitempty"`
+	BackendAddr  string `json:"backend_addr,omitempty"`
+	Status       int    `json:"status,omitempty"`
+	UpstreamHost string `json:"upstream_host,omitempty"`
+	BytesIn      int64  `json:"bytes_in,omitempty"`
+	BytesOut     int64  `json:"bytes_out,omitempty"`
+	DurationMs   int64  `json:"duration_ms,omitempty"`
+	CloseReason  string `json:"close_reason,omitempty"`
+}
+
+// eventLogger writes connection events either as the existing free-form log
+// lines or, when CMUX_PROXY_LOG_FORMAT=json, as one JSON object per line.
+// Events below the CMUX_PROXY_LOG_LEVEL threshold are dropped.
+type eventLogger struct {
+	json   bool
+	level  logLevel
+	output *log.Logger
+}
+
+func newEventLogger(format string, level logLevel) *eventLogger {
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case "", "text":
+		return &eventLogger{level: level}
+	case "json":
+		return &eventLogger{json: true, level: level, output: log.New(os.Stderr, "", 0)}
+	default:
+		log.Fatalf("invalid log format %q (expected text or json)", format)
+		return nil
+	}
+}
+
+// logf logs a message that is not tied to a connection.
+func (l *eventLogger) logf(level logLevel, format string, args ...any) {
+	message := fmt.Sprintf(format, args...)
+	l.emit(level, proxyEvent{Event: "log", Message: message}, message)
+}
+
+func (l *eventLogger) emit(level logLevel, event proxyEvent, text string) {
+	if level < l.level {
+		return
+	}
+	if !l.json {
+		if level != levelInfo {
+			text = level.String() + ": " + text
+		}
+		log.Print(text)
+		return
+	}
+	event.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	event.Level = level.String()
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("failed to serialize log event: %v", err)
+		return
+	}
+	l.output.Print(string(payload))
+}
+
+// errorLog returns a logger for http.Server and httputil.ReverseProxy, whose
+// own errors would otherwise bypass the event format and level.
+func (l *eventLogger) errorLog() *log.Logger {
+	return log.New(errorLogWriter{events: l}, "", 0)
+}
+
+type errorLogWriter struct {
+	events *eventLogger
+}
+
+func (w errorLogWriter) Write(p []byte) (int, error) {
+	w.events.logf(levelWarn, "%s", strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONLogCoversReverseProxyErrors(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		_, _ = w.Write([]byte("truncated"))
+		_ = http.NewResponseController(w).Flush()
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err == nil {
+			_ = conn.Close()
+		}
+	}))
+	defer backend.Close()
+	frontend, output := newAccessLogFrontend(t, backend)
+
+	resp, err := http.Get(frontend.URL + "/json/protocol")
+	if err == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		output.mu.Lock()
+		logged := output.buf.String()
+		output.mu.Unlock()
+		if strings.Contains(logged, "ReverseProxy read error") || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	output.mu.Lock()
+	defer output.mu.Unlock()
+	found := false
+	for _, line := range strings.Split(strings.TrimSpace(output.buf.String()), "\n") {
+		var event proxyEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("log line is not JSON: %q", line)
+		}
+		if strings.Contains(event.Message, "ReverseProxy read error") {
+			found = true
+			if event.Level != "warn" {
+				t.Errorf("reverse proxy error logged at %s, want warn", event.Level)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("reverse proxy error not logged as an event:\n%s", output.buf.String())
+	}
+}
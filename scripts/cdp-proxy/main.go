@@ -1,24 +1,92 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
+	"os/signal"
+	"runtime/debug"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
-type proxyConfig struct {
-	listenPort int
-	targetPort int
+// Build information, set at link time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=...".
+// Values left unset are filled from the Go build info at startup.
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+func init() {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	if version == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		version = info.Main.Version
+	}
+	for _, setting := range info.Settings {
+		switch {
+		case setting.Key == "vcs.revision" && commit == "unknown":
+			commit = setting.Value
+		case setting.Key == "vcs.time" && buildDate == "unknown":
+			buildDate = setting.Value
+		}
+	}
+}
+
+func buildInfo() string {
+	return fmt.Sprintf("%s (commit %s, built %s)", version, commit, buildDate)
+}
+
+// cdpRoute maps a path prefix on the proxy to one Chrome instance. The
+// default, single-target configuration is a route with an empty prefix.
+type cdpRoute struct {
+	prefix     string
 	targetHost string
+	targetPort int
 	hostHeader string
 }
 
+type proxyConfig struct {
+	listenPort     int
+	routes         []cdpRoute
+	publicAddr     publicAddress
+	logFormat      string
+	logLevel       logLevel
+	authUser       string
+	authPass       string
+	corsOrigins    []string
+	allowCIDRs     []*net.IPNet
+	trustedProxies []*net.IPNet
+
+	maxIdleConns        int
+	maxIdleConnsPerHost int
+	idleConnTimeout     time.Duration
+
+	targetScheme   string
+	targetInsecure bool
+	targetCAFile   string
+	targetTLSName  string
+
+	shutdownTimeout time.Duration
+	dialSource      *net.TCPAddr
+	dialNetwork     string
+	enableH2C       bool
+	landingPage     bool
+}
+
 func getenv(key string, fallback string) string {
 	value := os.Getenv(key)
 	if value == "" {
@@ -38,57 +106,503 @@ func parsePort(raw string, fallback int) int {
 	return value
 }
 
+// parseHost accepts a hostname or IP literal, with or without the brackets
+// used around IPv6 addresses, and returns it unbracketed so that
+// net.JoinHostPort can add them back exactly once. Link-local IPv6
+// literals may carry a zone, e.g. [fe80::1%eth0].
+func parseHost(raw string) string {
+	host, err := normalizeHost(raw)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	return host
+}
+
+func normalizeHost(raw string) (string, error) {
+	host := strings.TrimSpace(raw)
+	bracketed := strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]")
+	if bracketed {
+		host = host[1 : len(host)-1]
+	}
+	if host == "" || strings.ContainsAny(host, "[]/ ") {
+		return "", fmt.Errorf("invalid host value %q", raw)
+	}
+	if bracketed || strings.ContainsAny(host, ":%") {
+		// net.ParseIP does not understand zones, so validate the address
+		// part on its own and keep the zone for the dialer.
+		address, zone, zoned := strings.Cut(host, "%")
+		ip := net.ParseIP(address)
+		if ip == nil || (zoned && (zone == "" || ip.To4() != nil)) {
+			return "", fmt.Errorf("invalid host value %q", raw)
+		}
+	}
+	return host, nil
+}
+
+// parseRoutes reads a comma-separated list of prefix=host:port entries, e.g.
+// "/a=127.0.0.1:9222,/b=[::1]:9223".
+func parseRoutes(raw string) []cdpRoute {
+	routes, err := parseRouteList(raw)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	return routes
+}
+
+func parseRouteList(raw string) ([]cdpRoute, error) {
+	var routes []cdpRoute
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, target, ok := strings.Cut(entry, "=")
+		prefix = strings.TrimRight(strings.TrimSpace(prefix), "/")
+		if !ok || !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("invalid route %q (expected /prefix=host:port)", entry)
+		}
+		// Prefixes become ServeMux patterns, where braces and whitespace have
+		// meaning and a repeated pattern panics at registration.
+		if strings.ContainsAny(prefix, "{} \t") {
+			return nil, fmt.Errorf("invalid route prefix %q (must not contain braces or whitespace)", prefix)
+		}
+		if seen[prefix] {
+			return nil, fmt.Errorf("duplicate route prefix %q", prefix)
+		}
+		seen[prefix] = true
+		target = strings.TrimSpace(target)
+		host, port, err := net.SplitHostPort(target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route target %q: %v", target, err)
+		}
+		if strings.HasPrefix(target, "[") {
+			// SplitHostPort drops the brackets; keep them so only IP
+			// literals are accepted inside.
+			host = "[" + host + "]"
+		}
+		targetPort, err := strconv.Atoi(port)
+		if err != nil || targetPort <= 0 || targetPort > 65535 {
+			return nil, fmt.Errorf("invalid port value %q", port)
+		}
+		targetHost, err := normalizeHost(host)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, cdpRoute{
+			prefix:     prefix,
+			targetHost: targetHost,
+			targetPort: targetPort,
+			hostHeader: fmt.Sprintf("localhost:%d", targetPort),
+		})
+	}
+	return routes, nil
+}
+
+// parseSourceAddr reads the local address backend connections originate
+// from. Only the IP can be chosen: the transport keeps several connections
+// to each backend, and a fixed source port would fail every dial after the
+// first with "address already in use". A port of 0 is accepted as "any".
+func parseSourceAddr(raw string) *net.TCPAddr {
+	addr, err := sourceAddr(raw)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	return addr
+}
+
+func sourceAddr(raw string) (*net.TCPAddr, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, nil
+	}
+	if ip := net.ParseIP(strings.Trim(raw, "[]")); ip != nil {
+		return &net.TCPAddr{IP: ip}, nil
+	}
+	host, port, err := net.SplitHostPort(raw)
+	ip := net.ParseIP(host)
+	if err != nil || ip == nil {
+		return nil, fmt.Errorf("invalid dial source address %q", raw)
+	}
+	if port != "0" {
+		return nil, fmt.Errorf("invalid dial source address %q: only the IP can be set, not a port", raw)
+	}
+	return &net.TCPAddr{IP: ip}, nil
+}
+
+func parseDialNetwork(raw string, source *net.TCPAddr) string {
+	network := strings.ToLower(strings.TrimSpace(raw))
+	switch network {
+	case "":
+		network = "tcp"
+	case "tcp", "tcp4", "tcp6":
+	default:
+		log.Fatalf("invalid dial network %q (expected tcp, tcp4 or tcp6)", raw)
+	}
+	if source != nil {
+		isIPv4 := source.IP.To4() != nil
+		if (network == "tcp4" && !isIPv4) || (network == "tcp6" && isIPv4) {
+			log.Fatalf("dial source address %s does not match dial network %s", source, network)
+		}
+	}
+	return network
+}
+
+// publicAddress is where clients reach the proxy, used in rewritten debugger
+// URLs. An empty scheme means it follows the client's connection.
+type publicAddress struct {
+	scheme string
+	host   string
+}
+
+// parsePublicAddr reads the host:port clients use to reach the proxy,
+// optionally prefixed with ws://, wss://, http:// or https:// to fix the
+// scheme of rewritten debugger URLs, e.g. behind a TLS-terminating load
+// balancer that does not send X-Forwarded-Proto.
+func parsePublicAddr(raw string) publicAddress {
+	addr, err := publicAddr(raw)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	return addr
+}
+
+func publicAddr(raw string) (publicAddress, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return publicAddress{}, nil
+	}
+	invalid := fmt.Errorf("invalid public address %q (expected [scheme://]host:port)", raw)
+	var addr publicAddress
+	hostPort := raw
+	if scheme, rest, found := strings.Cut(raw, "://"); found {
+		switch strings.ToLower(scheme) {
+		case "ws", "http":
+			addr.scheme = "ws"
+		case "wss", "https":
+			addr.scheme = "wss"
+		default:
+			return publicAddress{}, invalid
+		}
+		hostPort = strings.TrimSuffix(rest, "/")
+	}
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return publicAddress{}, fmt.Errorf("invalid public address %q (expected [scheme://]host:port): %v", raw, err)
+	}
+	value, err := strconv.Atoi(port)
+	if err != nil || value <= 0 || value > 65535 {
+		return publicAddress{}, invalid
+	}
+	if strings.HasPrefix(hostPort, "[") {
+		host = "[" + host + "]"
+	}
+	if _, err := normalizeHost(host); err != nil {
+		return publicAddress{}, invalid
+	}
+	addr.host = hostPort
+	return addr, nil
+}
+
+// checkRouteNetworks rejects IP-literal route targets that cannot be reached
+// over the configured dial network, such as the default 127.0.0.1 with tcp6,
+// which would otherwise only surface as a 502 on every request. Hostnames
+// are left to the resolver.
+func checkRouteNetworks(network string, routes []cdpRoute) error {
+	if network == "tcp" {
+		return nil
+	}
+	for _, route := range routes {
+		address, _, _ := strings.Cut(route.targetHost, "%")
+		ip := net.ParseIP(address)
+		if ip == nil {
+			continue
+		}
+		isIPv4 := ip.To4() != nil
+		if (network == "tcp4" && !isIPv4) || (network == "tcp6" && isIPv4) {
+			target := net.JoinHostPort(route.targetHost, strconv.Itoa(route.targetPort))
+			return fmt.Errorf("route target %s does not match dial network %s", target, network)
+		}
+	}
+	return nil
+}
+
+func parseBool(raw string, fallback bool) bool {
+	if raw == "" {
+		return fallback
+	}
+	value, err := strconv.ParseBool(raw)
+	if err != nil {
+		log.Fatalf("invalid boolean value %q", raw)
+	}
+	return value
+}
+
+func parseScheme(raw string) string {
+	scheme := strings.ToLower(strings.TrimSpace(raw))
+	if scheme != "http" && scheme != "https" {
+		log.Fatalf("invalid target scheme %q (expected http or https)", raw)
+	}
+	return scheme
+}
+
+func parseCount(raw string, fallback int) int {
+	if raw == "" {
+		return fallback
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil || value < 0 {
+		log.Fatalf("invalid count value %q", raw)
+	}
+	return value
+}
+
+func parseDuration(raw string, fallback time.Duration) time.Duration {
+	if raw == "" {
+		return fallback
+	}
+	value, err := time.ParseDuration(raw)
+	if err != nil || value < 0 {
+		log.Fatalf("invalid duration value %q", raw)
+	}
+	return value
+}
+
+func healthHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok"))
+}
+
+type landingTarget struct {
+	Prefix string `json:"prefix"`
+	Target string `json:"target"`
+	JSON   string `json:"json"`
+}
+
+type landingStatus struct {
+	Service string          `json:"service"`
+	Version string          `json:"version"`
+	Commit  string          `json:"commit"`
+	Targets []landingTarget `json:"targets"`
+}
+
+// landingHandler answers GET / with a short status document instead of
+// passing it through to Chrome, which usually returns a bare 404 there.
+func landingHandler(cfg proxyConfig) http.Handler {
+	status := landingStatus{
+		Service: "cmux-cdp-proxy",
+		Version: version,
+		Commit:  commit,
+	}
+	for _, route := range cfg.routes {
+		status.Targets = append(status.Targets, landingTarget{
+			Prefix: route.prefix + "/",
+			Target: cfg.targetScheme + "://" + net.JoinHostPort(route.targetHost, strconv.Itoa(route.targetPort)),
+			JSON:   route.prefix + "/json",
+		})
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(status)
+	})
+}
+
 func loadConfig() proxyConfig {
 	targetPort := parsePort(getenv("CMUX_CDP_TARGET_PORT", "39382"), 39382)
+	dialSource := parseSourceAddr(os.Getenv("CMUX_PROXY_DIAL_SOURCE_ADDR"))
+	authUser := os.Getenv("CMUX_CDP_BASIC_AUTH_USER")
+	authPass := os.Getenv("CMUX_CDP_BASIC_AUTH_PASS")
+	if (authUser == "") != (authPass == "") {
+		log.Fatalf("CMUX_CDP_BASIC_AUTH_USER and CMUX_CDP_BASIC_AUTH_PASS must be set together")
+	}
+	routes := parseRoutes(os.Getenv("CMUX_CDP_ROUTES"))
+	if len(routes) == 0 {
+		routes = []cdpRoute{{
+			targetHost: parseHost(getenv("CMUX_CDP_TARGET_HOST", "127.0.0.1")),
+			targetPort: targetPort,
+			hostHeader: getenv("CMUX_CDP_TARGET_HOST_HEADER", fmt.Sprintf("localhost:%d", targetPort)),
+		}}
+	}
+	dialNetwork := parseDialNetwork(os.Getenv("CMUX_PROXY_DIAL_NETWORK"), dialSource)
+	if err := checkRouteNetworks(dialNetwork, routes); err != nil {
+		log.Fatalf("%v", err)
+	}
 	return proxyConfig{
-		listenPort: parsePort(getenv("CMUX_CDP_PROXY_PORT", "39381"), 39381),
-		targetPort: targetPort,
-		targetHost: getenv("CMUX_CDP_TARGET_HOST", "127.0.0.1"),
-		hostHeader: getenv("CMUX_CDP_TARGET_HOST_HEADER", fmt.Sprintf("localhost:%d", targetPort)),
+		listenPort:     parsePort(getenv("CMUX_CDP_PROXY_PORT", "39381"), 39381),
+		routes:         routes,
+		publicAddr:     parsePublicAddr(os.Getenv("CMUX_CDP_PUBLIC_ADDR")),
+		logFormat:      os.Getenv("CMUX_PROXY_LOG_FORMAT"),
+		logLevel:       parseLogLevel(os.Getenv("CMUX_PROXY_LOG_LEVEL")),
+		authUser:       authUser,
+		authPass:       authPass,
+		corsOrigins:    parseOriginList(os.Getenv("CMUX_CDP_CORS_ORIGIN")),
+		allowCIDRs:     parseCIDRList(os.Getenv("CMUX_PROXY_ALLOW_CIDRS")),
+		trustedProxies: parseCIDRList(os.Getenv("CMUX_PROXY_TRUSTED_PROXIES")),
+
+		maxIdleConns:        parseCount(os.Getenv("CMUX_CDP_MAX_IDLE_CONNS"), 100),
+		maxIdleConnsPerHost: parseCount(os.Getenv("CMUX_CDP_MAX_IDLE_CONNS_PER_HOST"), 32),
+		idleConnTimeout:     parseDuration(os.Getenv("CMUX_CDP_IDLE_CONN_TIMEOUT"), 90*time.Second),
+
+		targetScheme:   parseScheme(getenv("CMUX_CDP_TARGET_SCHEME", "http")),
+		targetInsecure: parseBool(os.Getenv("CMUX_CDP_TARGET_TLS_INSECURE"), false),
+		targetCAFile:   os.Getenv("CMUX_CDP_TARGET_CA_FILE"),
+		targetTLSName:  strings.TrimSpace(os.Getenv("CMUX_CDP_TARGET_TLS_SERVER_NAME")),
+
+		shutdownTimeout: parseDuration(os.Getenv("CMUX_CDP_SHUTDOWN_TIMEOUT"), 10*time.Second),
+		dialSource:      dialSource,
+		dialNetwork:     dialNetwork,
+		enableH2C:       parseBool(os.Getenv("CMUX_CDP_H2C"), false),
+		landingPage:     parseBool(os.Getenv("CMUX_CDP_LANDING_PAGE"), true),
 	}
 }
 
 func main() {
+	showVersion := flag.Bool("version", false, "print version information and exit")
+	flag.Parse()
+	if *showVersion {
+		fmt.Printf("cmux-cdp-proxy %s\n", buildInfo())
+		return
+	}
+
 	log.SetFlags(log.LstdFlags | log.LUTC)
 	cfg := loadConfig()
+	events := newEventLogger(cfg.logFormat, cfg.logLevel)
 
-	targetURL := &url.URL{
-		Scheme: "http",
-		Host:   net.JoinHostPort(cfg.targetHost, strconv.Itoa(cfg.targetPort)),
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	transport := newTransport(cfg)
+	events.logf(levelInfo, "dialing backends over %s", cfg.dialNetwork)
+	if cfg.dialSource != nil {
+		events.logf(levelInfo, "backend connections originate from %s", cfg.dialSource)
 	}
+	var upgrades sync.WaitGroup
 
-	proxy := httputil.NewSingleHostReverseProxy(targetURL)
-	originalDirector := proxy.Director
-	proxy.Director = func(req *http.Request) {
-		originalDirector(req)
-		req.Host = cfg.hostHeader
-		req.Header.Set("Host", cfg.hostHeader)
-		req.Header.Del("Proxy-Connection")
+	routes := http.NewServeMux()
+	for _, route := range cfg.routes {
+		proxy := trackUpgrades(newCDPProxy(cfg, route, transport, events), &upgrades)
+		if route.prefix == "" {
+			routes.Handle("/", proxy)
+			continue
+		}
+		routes.Handle(route.prefix+"/", http.StripPrefix(route.prefix, proxy))
+		events.logf(
+			levelInfo,
+			"routing %s/ to %s://%s (Host header: %s)",
+			route.prefix,
+			cfg.targetScheme,
+			net.JoinHostPort(route.targetHost, strconv.Itoa(route.targetPort)),
+			route.hostHeader,
+		)
 	}
 
-	proxy.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
-		log.Printf("proxy error: %v", err)
-		rw.Header().Set("Content-Type", "text/plain")
-		rw.WriteHeader(http.StatusBadGateway)
-		_, _ = rw.Write([]byte("Bad Gateway"))
+	if cfg.landingPage {
+		routes.Handle("GET /{$}", landingHandler(cfg))
 	}
 
-	proxy.FlushInterval = 100 * time.Millisecond
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthHandler)
+	handler := requireBasicAuth(routes, cfg.authUser, cfg.authPass)
+	handler = withCORS(handler, cfg.corsOrigins)
+	mux.Handle("/", withAccessLog(
+		allowCIDRs(handler, cfg.allowCIDRs, cfg.trustedProxies, events),
+		events,
+		cfg.trustedProxies,
+	))
+
+	// Proxied websockets are hijacked, so server.Shutdown does not wait for
+	// them. Their request contexts derive from baseCtx, and the reverse proxy
+	// closes the backend side once it is canceled.
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	defer cancelBase()
 
 	server := &http.Server{
 		Addr:              net.JoinHostPort("0.0.0.0", strconv.Itoa(cfg.listenPort)),
-		Handler:           proxy,
+		Handler:           mux,
 		ReadHeaderTimeout: 5 * time.Second,
+		ErrorLog:          events.errorLog(),
+		BaseContext: func(net.Listener) context.Context {
+			return baseCtx
+		},
+	}
+	if cfg.enableH2C {
+		// Cleartext HTTP/2 with prior knowledge, for load balancers that speak
+		// h2c. HTTP/1.1 stays enabled so websocket upgrades keep working.
+		server.Protocols = new(http.Protocols)
+		server.Protocols.SetHTTP1(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
+		events.logf(levelInfo, "accepting cleartext HTTP/2 (h2c)")
+	}
+
+	if len(cfg.routes) == 1 && cfg.routes[0].prefix == "" {
+		route := cfg.routes[0]
+		events.logf(
+			levelInfo,
+			"cmux CDP proxy %s listening on %d, forwarding to %s://%s (Host header: %s)",
+			buildInfo(),
+			cfg.listenPort,
+			cfg.targetScheme,
+			net.JoinHostPort(route.targetHost, strconv.Itoa(route.targetPort)),
+			route.hostHeader,
+		)
+	} else {
+		events.logf(levelInfo, "cmux CDP proxy %s listening on %d", buildInfo(), cfg.listenPort)
 	}
 
-	log.Printf(
-		"cmux CDP proxy listening on %d, forwarding to %s (Host header: %s)",
-		cfg.listenPort,
-		targetURL.Host,
-		cfg.hostHeader,
-	)
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		events.logf(levelError, "failed to listen: %v", err)
+		os.Exit(1)
+	}
+	if err := serveUntil(ctx, server, listener, &upgrades, cancelBase, cfg.shutdownTimeout, events); err != nil {
+		events.logf(levelError, "server exited: %v", err)
+		os.Exit(1)
+	}
+	events.logf(levelInfo, "cdp proxy stopped")
+}
+
+// serveUntil serves on listener until ctx is done, then shuts server down,
+// waiting up to timeout for in-flight requests and the websocket sessions
+// counted in upgrades. Sessions still open at the deadline are closed by
+// canceling the server's base context with cancelBase. It returns an error
+// only if the server stopped on its own.
+func serveUntil(ctx context.Context, server *http.Server, listener net.Listener, upgrades *sync.WaitGroup, cancelBase context.CancelFunc, timeout time.Duration, events *eventLogger) error {
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-serverErr:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	case <-ctx.Done():
+	}
+
+	events.logf(levelInfo, "shutting down, waiting up to %s for in-flight requests", timeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		events.logf(levelWarn, "shutdown did not complete: %v", err)
+	}
 
-	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Fatalf("server exited: %v", err)
+	drained := make(chan struct{})
+	go func() {
+		upgrades.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-shutdownCtx.Done():
+		events.logf(levelWarn, "closing websocket sessions still open after %s", timeout)
+		cancelBase()
+		<-drained
 	}
+	return nil
 }
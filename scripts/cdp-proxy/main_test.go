@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNormalizeHost(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{raw: "127.0.0.1", want: "127.0.0.1"},
+		{raw: "chrome.internal", want: "chrome.internal"},
+		{raw: " localhost ", want: "localhost"},
+		{raw: "::1", want: "::1"},
+		{raw: "[::1]", want: "::1"},
+		{raw: "2001:db8::1", want: "2001:db8::1"},
+		{raw: "[2001:db8:0:0:0:0:0:1]", want: "2001:db8:0:0:0:0:0:1"},
+		{raw: "fe80::1%eth0", want: "fe80::1%eth0"},
+		{raw: "[fe80::1%eth0]", want: "fe80::1%eth0"},
+		{raw: "", wantErr: true},
+		{raw: "[]", wantErr: true},
+		{raw: "[::1", wantErr: true},
+		{raw: "::1]", wantErr: true},
+		{raw: "[[::1]]", wantErr: true},
+		{raw: "[chrome.internal]", wantErr: true},
+		{raw: "2001:db8::zz", wantErr: true},
+		{raw: "host:9222", wantErr: true},
+		{raw: "fe80::1%", wantErr: true},
+		{raw: "127.0.0.1%eth0", wantErr: true},
+		{raw: "chrome/internal", wantErr: true},
+		{raw: "chrome internal", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeHost(tt.raw)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("normalizeHost(%q) = %q, want error", tt.raw, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("normalizeHost(%q) returned error: %v", tt.raw, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("normalizeHost(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestTargetHostJoinsWithSingleBrackets(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{raw: "127.0.0.1", want: "127.0.0.1:9222"},
+		{raw: "::1", want: "[::1]:9222"},
+		{raw: "[::1]", want: "[::1]:9222"},
+		{raw: "[2001:db8::1]", want: "[2001:db8::1]:9222"},
+		{raw: "[fe80::1%eth0]", want: "[fe80::1%eth0]:9222"},
+	}
+	for _, tt := range tests {
+		host, err := normalizeHost(tt.raw)
+		if err != nil {
+			t.Fatalf("normalizeHost(%q) returned error: %v", tt.raw, err)
+		}
+		if got := net.JoinHostPort(host, "9222"); got != tt.want {
+			t.Errorf("JoinHostPort(normalizeHost(%q)) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestParseRouteList(t *testing.T) {
+	tests := []struct {
+		raw      string
+		wantAddr []string
+		wantErr  bool
+	}{
+		{raw: "", wantAddr: nil},
+		{raw: "/a=127.0.0.1:9222", wantAddr: []string{"127.0.0.1:9222"}},
+		{raw: "/a=[::1]:9222", wantAddr: []string{"[::1]:9222"}},
+		{raw: "/a=[2001:db8::1]:9222, /b/=[fe80::1%eth0]:9223", wantAddr: []string{"[2001:db8::1]:9222", "[fe80::1%eth0]:9223"}},
+		{raw: "/a=::1:9222", wantErr: true},
+		{raw: "/a=[[::1]]:9222", wantErr: true},
+		{raw: "/a=[::1]", wantErr: true},
+		{raw: "/a=[::1]:0", wantErr: true},
+		{raw: "/a=[::1]:http", wantErr: true},
+		{raw: "/a=[chrome.internal]:9222", wantErr: true},
+		{raw: "a=127.0.0.1:9222", wantErr: true},
+		{raw: "/a", wantErr: true},
+		{raw: "/a=127.0.0.1:9222,/a/=127.0.0.1:9223", wantErr: true},
+		{raw: "/a=127.0.0.1:9222,/b=127.0.0.1:9223,/a=127.0.0.1:9224", wantErr: true},
+		{raw: "/{id}=127.0.0.1:9222", wantErr: true},
+		{raw: "/a}=127.0.0.1:9222", wantErr: true},
+		{raw: "/a b=127.0.0.1:9222", wantErr: true},
+	}
+	for _, tt := range tests {
+		routes, err := parseRouteList(tt.raw)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseRouteList(%q) = %+v, want error", tt.raw, routes)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRouteList(%q) returned error: %v", tt.raw, err)
+			continue
+		}
+		if len(routes) != len(tt.wantAddr) {
+			t.Errorf("parseRouteList(%q) returned %d routes, want %d", tt.raw, len(routes), len(tt.wantAddr))
+			continue
+		}
+		for i, route := range routes {
+			got := net.JoinHostPort(route.targetHost, strconv.Itoa(route.targetPort))
+			if got != tt.wantAddr[i] {
+				t.Errorf("parseRouteList(%q)[%d] target = %q, want %q", tt.raw, i, got, tt.wantAddr[i])
+			}
+		}
+	}
+}
+
+func TestSourceAddr(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{raw: "", want: "<nil>"},
+		{raw: "10.0.0.5", want: "10.0.0.5:0"},
+		{raw: "10.0.0.5:0", want: "10.0.0.5:0"},
+		{raw: "::1", want: "[::1]:0"},
+		{raw: "[::1]", want: "[::1]:0"},
+		{raw: "[::1]:0", want: "[::1]:0"},
+		{raw: "10.0.0.5:40000", wantErr: true},
+		{raw: "[::1]:40000", wantErr: true},
+		{raw: "10.0.0.5:http", wantErr: true},
+		{raw: "localhost", wantErr: true},
+		{raw: "localhost:0", wantErr: true},
+	}
+	for _, tt := range tests {
+		addr, err := sourceAddr(tt.raw)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("sourceAddr(%q) = %v, want error", tt.raw, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("sourceAddr(%q) returned error: %v", tt.raw, err)
+			continue
+		}
+		got := "<nil>"
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != tt.want {
+			t.Errorf("sourceAddr(%q) = %s, want %s", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestCheckRouteNetworks(t *testing.T) {
+	routes := func(hosts ...string) []cdpRoute {
+		var out []cdpRoute
+		for _, host := range hosts {
+			out = append(out, cdpRoute{targetHost: host, targetPort: 9222})
+		}
+		return out
+	}
+	tests := []struct {
+		network string
+		routes  []cdpRoute
+		wantErr bool
+	}{
+		{network: "tcp", routes: routes("127.0.0.1", "::1")},
+		{network: "tcp4", routes: routes("127.0.0.1", "chrome.internal")},
+		{network: "tcp6", routes: routes("::1", "fe80::1%eth0", "chrome.internal")},
+		{network: "tcp6", routes: routes("127.0.0.1"), wantErr: true},
+		{network: "tcp6", routes: routes("::1", "10.0.0.5"), wantErr: true},
+		{network: "tcp4", routes: routes("::1"), wantErr: true},
+		{network: "tcp4", routes: routes("fe80::1%eth0"), wantErr: true},
+	}
+	for _, tt := range tests {
+		err := checkRouteNetworks(tt.network, tt.routes)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("checkRouteNetworks(%s, %+v) = %v, wantErr %v", tt.network, tt.routes, err, tt.wantErr)
+		}
+	}
+}
+
+func TestPublicAddr(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    publicAddress
+		wantErr bool
+	}{
+		{raw: "", want: publicAddress{}},
+		{raw: "proxy.example:443", want: publicAddress{host: "proxy.example:443"}},
+		{raw: " 10.0.0.5:39381 ", want: publicAddress{host: "10.0.0.5:39381"}},
+		{raw: "[2001:db8::1]:443", want: publicAddress{host: "[2001:db8::1]:443"}},
+		{raw: "https://proxy.example:443", want: publicAddress{scheme: "wss", host: "proxy.example:443"}},
+		{raw: "wss://proxy.example:443/", want: publicAddress{scheme: "wss", host: "proxy.example:443"}},
+		{raw: "HTTP://proxy.example:8080", want: publicAddress{scheme: "ws", host: "proxy.example:8080"}},
+		{raw: "ws://[2001:db8::1]:39381", want: publicAddress{scheme: "ws", host: "[2001:db8::1]:39381"}},
+		{raw: "proxy.example", wantErr: true},
+		{raw: "https://proxy.example", wantErr: true},
+		{raw: "ftp://proxy.example:443", wantErr: true},
+		{raw: "https://proxy.example:443/cdp", wantErr: true},
+		{raw: "proxy.example:443/cdp", wantErr: true},
+		{raw: "proxy.example:0", wantErr: true},
+		{raw: ":443", wantErr: true},
+		{raw: "[proxy.example]:443", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := publicAddr(tt.raw)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("publicAddr(%q) = %+v, want error", tt.raw, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("publicAddr(%q) returned error: %v", tt.raw, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("publicAddr(%q) = %+v, want %+v", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestServeUntilClosesWebsocketsAtDeadline(t *testing.T) {
+	backend := websocketBackend(t, func(_ *http.Request, rw *bufio.ReadWriter) {
+		_, _ = io.Copy(io.Discard, rw)
+	})
+	cfg := proxyConfig{targetScheme: "http", dialNetwork: "tcp"}
+	events := newEventLogger("", levelError)
+	var upgrades sync.WaitGroup
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	defer cancelBase()
+	server := &http.Server{
+		Handler: trackUpgrades(newCDPProxy(cfg, backendRoute(t, backend), testTransport(t, cfg), events), &upgrades),
+		BaseContext: func(net.Listener) context.Context {
+			return baseCtx
+		},
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const timeout = 200 * time.Millisecond
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	done := make(chan error, 1)
+	go func() {
+		done <- serveUntil(ctx, server, listener, &upgrades, cancelBase, timeout, events)
+	}()
+
+	conn, reader, resp := dialWebsocket(t, listener.Addr().String(), "/devtools/page/A1")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", resp.StatusCode)
+	}
+
+	start := time.Now()
+	stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("serveUntil returned error: %v", err)
+		}
+	case <-time.After(timeout + 5*time.Second):
+		t.Fatal("serveUntil did not return")
+	}
+	if elapsed := time.Since(start); elapsed > timeout+time.Second {
+		t.Errorf("serveUntil took %s, want about %s", elapsed, timeout)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("read from open websocket after shutdown = %v, want EOF", err)
+	}
+}
+
+func TestServeUntilReportsServerFailure(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = listener.Close()
+	var upgrades sync.WaitGroup
+	err = serveUntil(context.Background(), &http.Server{}, listener, &upgrades, func() {}, time.Second, newEventLogger("", levelError))
+	if err == nil {
+		t.Fatal("serveUntil returned nil for a closed listener")
+	}
+}
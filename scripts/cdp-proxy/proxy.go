@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// newTransport returns the transport shared by every route. When the target
+// scheme is https, backend certificates are verified against the system
+// roots, or against CMUX_CDP_TARGET_CA_FILE when it is set. The certificate
+// is checked against the dialed host unless CMUX_CDP_TARGET_TLS_SERVER_NAME
+// names the one the backend presents, e.g. when targets are IP literals.
+func newTransport(cfg proxyConfig) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if cfg.dialSource != nil {
+		dialer.LocalAddr = cfg.dialSource
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, _ string, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, cfg.dialNetwork, addr)
+	}
+	transport.MaxIdleConns = cfg.maxIdleConns
+	transport.MaxIdleConnsPerHost = cfg.maxIdleConnsPerHost
+	transport.IdleConnTimeout = cfg.idleConnTimeout
+
+	if cfg.targetScheme == "https" {
+		tlsConfig := &tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			InsecureSkipVerify: cfg.targetInsecure,
+			ServerName:         cfg.targetTLSName,
+		}
+		if cfg.targetCAFile != "" {
+			pem, err := os.ReadFile(cfg.targetCAFile)
+			if err != nil {
+				log.Fatalf("failed to read CA bundle: %v", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				log.Fatalf("no certificates found in CA bundle %q", cfg.targetCAFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	return transport
+}
+
+// trackUpgrades counts in-flight websocket sessions so shutdown can wait for
+// them after the HTTP server itself has stopped.
+func trackUpgrades(next http.Handler, upgrades *sync.WaitGroup) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if isWebSocketRequest(req) {
+			upgrades.Add(1)
+			defer upgrades.Done()
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// newCDPProxy builds the reverse proxy for a single route. Chrome only
+// accepts DevTools connections whose Host is localhost or an IP, so the Host
+// header is always rewritten to route.hostHeader. Requests arrive with the
+// route prefix already stripped, so events add it back to match the access
+// log.
+func newCDPProxy(cfg proxyConfig, route cdpRoute, transport http.RoundTripper, events *eventLogger) *httputil.ReverseProxy {
+	targetURL := &url.URL{
+		Scheme: cfg.targetScheme,
+		Host:   net.JoinHostPort(route.targetHost, strconv.Itoa(route.targetPort)),
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(targetURL)
+	proxy.Transport = transport
+	originalDirector := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		publicHost := forwardedHost(req, cfg.trustedProxies)
+		publicScheme := forwardedScheme(req, cfg.trustedProxies)
+		originalDirector(req)
+		if isWebSocketRequest(req) {
+			events.emit(levelDebug, proxyEvent{
+				Event:       "websocket_upgrade",
+				RemoteAddr:  clientIP(req, cfg.trustedProxies),
+				Path:        route.prefix + req.URL.Path,
+				Protocol:    "websocket",
+				BackendAddr: targetURL.Host,
+			}, fmt.Sprintf("proxying websocket upgrade for %s", route.prefix+req.URL.Path))
+		}
+		req.Header.Set("X-Forwarded-Host", publicHost)
+		req.Header.Set("X-Forwarded-Proto", publicScheme)
+		req.Host = route.hostHeader
+		recordUpstreamHost(req, route.hostHeader)
+		req.Header.Set("Host", route.hostHeader)
+		req.Header.Del("Proxy-Connection")
+	}
+
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		replaceBackendCORS(resp, cfg.corsOrigins)
+		publicHost := cfg.publicAddr.host
+		if publicHost == "" {
+			publicHost = resp.Request.Header.Get("X-Forwarded-Host")
+		}
+		wsScheme := cfg.publicAddr.scheme
+		if wsScheme == "" {
+			wsScheme = "ws"
+			if resp.Request.Header.Get("X-Forwarded-Proto") == "https" {
+				wsScheme = "wss"
+			}
+		}
+		return rewriteDebuggerURLs(resp, wsScheme, publicHost, route.prefix)
+	}
+
+	proxy.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
+		protocol := "http"
+		if isWebSocketRequest(req) {
+			protocol = "websocket"
+		}
+		events.emit(levelWarn, proxyEvent{
+			Event:       "proxy_error",
+			RemoteAddr:  clientIP(req, cfg.trustedProxies),
+			Method:      req.Method,
+			Path:        route.prefix + req.URL.Path,
+			Protocol:    protocol,
+			BackendAddr: targetURL.Host,
+			CloseReason: err.Error(),
+		}, fmt.Sprintf("proxy error: %v", err))
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.WriteHeader(http.StatusBadGateway)
+		_, _ = rw.Write([]byte("Bad Gateway"))
+	}
+
+	proxy.ErrorLog = events.errorLog()
+	proxy.FlushInterval = 100 * time.Millisecond
+	return proxy
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// backendRoute returns the route a proxy under test uses to reach backend.
+func backendRoute(tb testing.TB, backend *httptest.Server) cdpRoute {
+	tb.Helper()
+	host, port, err := net.SplitHostPort(backend.Listener.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	targetPort, err := strconv.Atoi(port)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return cdpRoute{targetHost: host, targetPort: targetPort, hostHeader: "localhost:" + port}
+}
+
+// testTransport is newTransport with its idle connections closed when the
+// test ends.
+func testTransport(tb testing.TB, cfg proxyConfig) *http.Transport {
+	transport := newTransport(cfg)
+	tb.Cleanup(transport.CloseIdleConnections)
+	return transport
+}
+
+// websocketBackend starts a backend that answers every request with a 101
+// and hands the hijacked connection to session, if any, before closing it.
+func websocketBackend(tb testing.TB, session func(req *http.Request, rw *bufio.ReadWriter)) *httptest.Server {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		_ = rw.Flush()
+		if session != nil {
+			session(req, rw)
+		}
+	}))
+	tb.Cleanup(backend.Close)
+	return backend
+}
+
+// dialWebsocket sends a websocket upgrade for path to addr, with any extra
+// header lines, and returns the connection and the response read from it.
+func dialWebsocket(t *testing.T, addr string, path string, headers ...string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	request := "GET " + path + " HTTP/1.1\r\nHost: proxy.example\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"
+	for _, header := range headers {
+		request += header + "\r\n"
+	}
+	if _, err := io.WriteString(conn, request+"\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, reader, resp
+}
+
+func TestNewTransportTLSServerName(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw})
+	if err := os.WriteFile(caFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The httptest certificate is issued for example.com and the loopback
+	// addresses only.
+	tests := []struct {
+		serverName string
+		wantErr    bool
+	}{
+		{serverName: ""},
+		{serverName: "example.com"},
+		{serverName: "chrome.internal", wantErr: true},
+	}
+	for _, tt := range tests {
+		transport := newTransport(proxyConfig{
+			targetScheme:  "https",
+			targetCAFile:  caFile,
+			targetTLSName: tt.serverName,
+			dialNetwork:   "tcp",
+		})
+		resp, err := (&http.Client{Transport: transport}).Get(backend.URL)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		if (err != nil) != tt.wantErr {
+			t.Errorf("server name %q: err = %v, wantErr %v", tt.serverName, err, tt.wantErr)
+		}
+		transport.CloseIdleConnections()
+	}
+}
+
+// BenchmarkProxyTransport compares http.DefaultTransport, which keeps only
+// two idle connections per host, against the pooled transport the proxy
+// shares across routes, under parallel load against one backend.
+func BenchmarkProxyTransport(b *testing.B) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"Browser":"HeadlessChrome"}`))
+	}))
+	defer backend.Close()
+
+	cfg := proxyConfig{
+		routes:              []cdpRoute{backendRoute(b, backend)},
+		targetScheme:        "http",
+		dialNetwork:         "tcp",
+		maxIdleConns:        100,
+		maxIdleConnsPerHost: 32,
+		idleConnTimeout:     90 * time.Second,
+	}
+	events := newEventLogger("", levelError)
+
+	transports := []struct {
+		name      string
+		transport *http.Transport
+	}{
+		{"default", http.DefaultTransport.(*http.Transport).Clone()},
+		{"tuned", newTransport(cfg)},
+	}
+	for _, tc := range transports {
+		b.Run(tc.name, func(b *testing.B) {
+			defer tc.transport.CloseIdleConnections()
+			frontend := httptest.NewServer(newCDPProxy(cfg, cfg.routes[0], tc.transport, events))
+			defer frontend.Close()
+			client := frontend.Client()
+			client.Transport.(*http.Transport).MaxIdleConnsPerHost = 256
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					resp, err := client.Get(frontend.URL + "/json/version")
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					_, _ = io.Copy(io.Discard, resp.Body)
+					_ = resp.Body.Close()
+				}
+			})
+		})
+	}
+}
@@ -10,9 +10,17 @@ VERSION=${1:-latest}
 echo "Building multi-platform Docker image..."
 echo "This will build for linux/amd64 and linux/arm64"
 
+# .git is excluded from the build context, so the commit is passed in for the
+# binaries' version info.
+BUILD_TIME=$(date -u +"%Y-%m-%dT%H:%M:%SZ")
+COMMIT=$(git rev-parse HEAD 2>/dev/null || echo unknown)
+
 # Use buildx to build and push in one step (more efficient)
 docker buildx build \
   --platform linux/amd64,linux/arm64 \
+  --build-arg "CMUX_VERSION=${VERSION}" \
+  --build-arg "CMUX_COMMIT=${COMMIT}" \
+  --build-arg "CMUX_BUILD_DATE=${BUILD_TIME}" \
   --tag ${REPO}:${VERSION} \
   --tag ${REPO}:latest \
   --push \
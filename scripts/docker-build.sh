@@ -12,7 +12,13 @@ echo "Building Docker image for current platform..."
 
 # Add a build timestamp label to force a new layer (helps with push issues)
 BUILD_TIME=$(date -u +"%Y-%m-%dT%H:%M:%SZ")
+# .git is excluded from the build context, so the commit is passed in for the
+# binaries' version info.
+COMMIT=$(git rev-parse HEAD 2>/dev/null || echo unknown)
 docker build \
+    --build-arg "CMUX_VERSION=${VERSION}" \
+    --build-arg "CMUX_COMMIT=${COMMIT}" \
+    --build-arg "CMUX_BUILD_DATE=${BUILD_TIME}" \
     --label "build.version=${VERSION}" \
     --label "build.time=${BUILD_TIME}" \
     -t ${REPO}:${VERSION} \